@@ -0,0 +1,99 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package api ties the HTTP layer to the rest of tsuru.
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/auth"
+)
+
+// authError is a stable, machine-readable error code exposed to API
+// clients, distinct from the free-form message in Error.
+type authError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *authError) Error() string {
+	return e.Message
+}
+
+var (
+	errTokenRevokedHTTP           = &authError{Code: "token_revoked", Message: auth.ErrTokenRevoked.Error()}
+	errTokenExpiredHTTP           = &authError{Code: "token_expired", Message: auth.ErrTokenExpired.Error()}
+	errTokenNotFoundHTTP          = &authError{Code: "token_not_found", Message: auth.ErrTokenNotFound.Error()}
+	errInsufficientScopeHTTP      = &authError{Code: "insufficient_scope", Message: "You don't have the required scope for this action"}
+	errInsufficientCapabilityHTTP = &authError{Code: "insufficient_capability", Message: "This token is not authorized to perform this action"}
+)
+
+// authenticate reads the token from the request's Authorization header
+// (in the form "bearer <token>") and resolves it through auth.GetToken,
+// translating its sentinel errors into a stable HTTP status and error
+// code. Revoked tokens must not be treated as merely expired or missing:
+// a client should be told, unambiguously, that the token was invalidated.
+func authenticate(r *http.Request) (*auth.Token, int, error) {
+	header := r.Header.Get("Authorization")
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, http.StatusUnauthorized, errTokenNotFoundHTTP
+	}
+	t, err := auth.GetToken(fields[1])
+	switch err {
+	case nil:
+		return t, http.StatusOK, nil
+	case auth.ErrTokenRevoked:
+		return nil, http.StatusUnauthorized, errTokenRevokedHTTP
+	case auth.ErrTokenExpired:
+		return nil, http.StatusUnauthorized, errTokenExpiredHTTP
+	default:
+		return nil, http.StatusUnauthorized, errTokenNotFoundHTTP
+	}
+}
+
+// requireScope wraps authenticate, additionally requiring that the
+// resolved token be a user token (not an application token, which carries
+// capabilities instead of scopes and must go through requireCapability)
+// and, unless it predates scopes altogether (the full-access session token
+// from newUserToken, which never sets Label), that it carry the given
+// scope. Label, not len(Scopes), is what distinguishes the two: a named
+// token created with an empty scope list (CreateNamedUserToken(..., nil,
+// ...)) still sets Label and must be held to its (empty) scope list rather
+// than treated as unrestricted. A token that lacks a required scope is
+// rejected with 403, never 401: it authenticated fine, it just isn't
+// allowed to do this.
+func requireScope(r *http.Request, scope string) (*auth.Token, int, error) {
+	t, status, err := authenticate(r)
+	if err != nil {
+		return nil, status, err
+	}
+	if t.AppName != "" {
+		return nil, http.StatusForbidden, errInsufficientScopeHTTP
+	}
+	if t.Label != "" && !t.HasScope(scope) {
+		return nil, http.StatusForbidden, errInsufficientScopeHTTP
+	}
+	return t, http.StatusOK, nil
+}
+
+// requireCapability is the application-token analogue of requireScope:
+// internal components (the healer, the deployer, ...) authenticate with
+// application tokens rather than user tokens, and must pass through this
+// check before acting on tsuru's behalf, so that a compromised component
+// token only grants the capability it actually needs instead of full API
+// access. A user token, which carries no capabilities at all, is rejected
+// here rather than let through unchecked.
+func requireCapability(r *http.Request, capability string) (*auth.Token, int, error) {
+	t, status, err := authenticate(r)
+	if err != nil {
+		return nil, status, err
+	}
+	if t.AppName == "" || !t.Authorize(capability) {
+		return nil, http.StatusForbidden, errInsufficientCapabilityHTTP
+	}
+	return t, http.StatusOK, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/db"
+	"labix.org/v2/mgo/bson"
+	"launchpad.net/gocheck"
+)
+
+func Test(t *testing.T) {
+	gocheck.TestingT(t)
+}
+
+type S struct {
+	conn *db.Storage
+	user *auth.User
+}
+
+var _ = gocheck.Suite(&S{})
+
+func (s *S) SetUpSuite(c *gocheck.C) {
+	config.Set("database:name", "tsuru_api_tests")
+	config.Set("auth:token-key", "test-suite-secret")
+}
+
+func (s *S) SetUpTest(c *gocheck.C) {
+	var err error
+	s.conn, err = db.Conn()
+	c.Assert(err, gocheck.IsNil)
+	s.user = &auth.User{Email: "timeredbull@globo.com", Password: "123456"}
+	err = s.conn.Users().Insert(s.user)
+	c.Assert(err, gocheck.IsNil)
+}
+
+func (s *S) TearDownTest(c *gocheck.C) {
+	s.conn.Users().Database.DropDatabase()
+	s.conn.Close()
+}
+
+func request(tokenString string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "bearer "+tokenString)
+	return r
+}
+
+func (s *S) TestAuthenticateWithEmptyToken(c *gocheck.C) {
+	_, status, err := authenticate(request(""))
+	c.Assert(err, gocheck.NotNil)
+	c.Assert(status, gocheck.Equals, http.StatusUnauthorized)
+}
+
+func (s *S) TestRequireScopeRejectsMissingScope(c *gocheck.C) {
+	t, err := auth.CreateNamedUserToken(s.user, "my-laptop", []string{"app-read"}, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	_, status, err := requireScope(request(t.Token), "app-deploy")
+	c.Assert(err, gocheck.Equals, errInsufficientScopeHTTP)
+	c.Assert(status, gocheck.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestRequireScopeAcceptsMatchingScope(c *gocheck.C) {
+	t, err := auth.CreateNamedUserToken(s.user, "my-laptop", []string{"app-deploy"}, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	got, status, err := requireScope(request(t.Token), "app-deploy")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(got.Token, gocheck.Equals, t.Token)
+}
+
+func (s *S) TestRequireScopeRejectsApplicationToken(c *gocheck.C) {
+	t, err := auth.CreateApplicationToken("tsuru-healer", []string{"node:healer"})
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	_, status, err := requireScope(request(t.Token), "app-deploy")
+	c.Assert(err, gocheck.Equals, errInsufficientScopeHTTP)
+	c.Assert(status, gocheck.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestRequireCapabilityRejectsMissingCapability(c *gocheck.C) {
+	t, err := auth.CreateApplicationToken("tsuru-healer", []string{"node:healer"})
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	_, status, err := requireCapability(request(t.Token), "app:deploy")
+	c.Assert(err, gocheck.Equals, errInsufficientCapabilityHTTP)
+	c.Assert(status, gocheck.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestRequireCapabilityAcceptsMatchingCapability(c *gocheck.C) {
+	t, err := auth.CreateApplicationToken("tsuru-healer", []string{"node:healer"})
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	got, status, err := requireCapability(request(t.Token), "node:healer")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(got.Token, gocheck.Equals, t.Token)
+}
+
+func (s *S) TestRequireCapabilityRejectsUserToken(c *gocheck.C) {
+	t, err := auth.CreateNamedUserToken(s.user, "my-laptop", []string{"app-deploy"}, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	_, status, err := requireCapability(request(t.Token), "node:healer")
+	c.Assert(err, gocheck.Equals, errInsufficientCapabilityHTTP)
+	c.Assert(status, gocheck.Equals, http.StatusForbidden)
+}
@@ -0,0 +1,48 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"launchpad.net/gocheck"
+)
+
+func Test(t *testing.T) {
+	gocheck.TestingT(t)
+}
+
+type S struct {
+	conn  *db.Storage
+	user  *User
+	token *Token
+}
+
+var _ = gocheck.Suite(&S{})
+
+func (s *S) SetUpSuite(c *gocheck.C) {
+	config.Set("database:name", "tsuru_auth_tests")
+	config.Set("auth:token-key", "test-suite-secret")
+}
+
+func (s *S) SetUpTest(c *gocheck.C) {
+	var err error
+	s.conn, err = db.Conn()
+	c.Assert(err, gocheck.IsNil)
+	s.user = &User{Email: "timeredbull@globo.com", Password: "123456"}
+	err = s.conn.Users().Insert(s.user)
+	c.Assert(err, gocheck.IsNil)
+	s.token, err = newUserToken(s.user)
+	c.Assert(err, gocheck.IsNil)
+	err = s.conn.Tokens().Insert(s.token)
+	c.Assert(err, gocheck.IsNil)
+}
+
+func (s *S) TearDownTest(c *gocheck.C) {
+	s.conn.Users().Database.DropDatabase()
+	s.conn.Close()
+}
@@ -0,0 +1,642 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto"
+	_ "crypto/md5"
+	"crypto/rand"
+	_ "crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	ErrTokenNotFound         = errors.New("Token not found")
+	ErrTokenExpired          = errors.New("Token has expired")
+	ErrTokenRevoked          = errors.New("Token has been revoked")
+	ErrDuplicateTokenLabel   = errors.New("User already has a token with this label")
+	ErrPasswordTokenExpired  = errors.New("Password token has expired")
+	ErrPasswordTokenUsed     = errors.New("Password token already used")
+	ErrTooManyPasswordTokens = errors.New("Too many password reset requests, please try again later")
+)
+
+// allowedSigningMethods pins the "alg" header accepted when verifying a
+// token, so a token crafted with alg=none (or any algorithm we don't
+// explicitly trust) is never accepted.
+var allowedSigningMethods = map[string]bool{
+	"HS256": true,
+	"RS256": true,
+}
+
+const (
+	tokenIssuer        = "tsuru"
+	defaultSigningAlg  = "HS256"
+	defaultTokenExpire = 7 * 24 * time.Hour
+
+	defaultPasswordTokenExpire   = time.Hour
+	maxOutstandingPasswordTokens = 3
+	passwordTokenRateLimitWindow = time.Hour
+)
+
+// passwordTokenExpiration returns how long a freshly created password
+// reset token remains valid, read from the "auth:password-token-expire"
+// entry in tsuru.conf (a duration string, e.g. "1h") when present.
+func passwordTokenExpiration() time.Duration {
+	d, err := config.GetString("auth:password-token-expire")
+	if err != nil {
+		return defaultPasswordTokenExpire
+	}
+	parsed, err := time.ParseDuration(d)
+	if err != nil {
+		return defaultPasswordTokenExpire
+	}
+	return parsed
+}
+
+// Token represents an access token, signed as a compact JWS, issued either
+// to a user or to an application. ValidUntil mirrors the token's "exp"
+// claim and is kept alongside it in MongoDB so that introspection and
+// revocation do not require decoding the token itself.
+type Token struct {
+	Token      string    `json:"token"`
+	ValidUntil time.Time `json:"valid-until"`
+	UserEmail  string    `json:"email"`
+	AppName    string    `json:"app"`
+	// Label is only set on named tokens created through
+	// CreateNamedUserToken; omitempty keeps it out of session tokens'
+	// documents, so the sparse unique index on {useremail, label} only
+	// constrains named tokens.
+	Label  string   `json:"label,omitempty" bson:"label,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Capabilities lists the fine-grained actions (e.g. "app:deploy",
+	// "node:healer") an application token is authorized to perform. Only
+	// application tokens (AppName set) carry capabilities; user tokens
+	// use Scopes instead.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// legacyCapability is granted to every application token that existed
+// before capabilities were introduced, so upgrading does not lock out
+// already-deployed components (the healer, old deploy agents, ...) that
+// were issued a token under the old, all-powerful model.
+const legacyCapability = "legacy:*"
+
+// Authorize reports whether the token is allowed to perform capability.
+// A token holding legacyCapability authorizes everything.
+func (t *Token) Authorize(capability string) bool {
+	for _, cp := range t.Capabilities {
+		if cp == capability || cp == legacyCapability {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the token is allowed to perform actions tagged
+// with scope. It does not by itself distinguish a legacy/session token
+// (unrestricted) from a named token with an empty scope list (restricted
+// to nothing); callers that need that distinction should check t.Label,
+// not len(t.Scopes) — a named token always sets Label, even when Scopes
+// is empty.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordToken is a single-use token issued when a user asks to reset
+// their password. It expires after ValidUntil even if never redeemed.
+type PasswordToken struct {
+	Token      string    `bson:"_id"`
+	UserEmail  string    `bson:"useremail"`
+	Used       bool      `bson:"used"`
+	ValidUntil time.Time `bson:"validuntil"`
+	CreatedAt  time.Time `bson:"createdat"`
+}
+
+func signingMethod() jwt.SigningMethod {
+	name, err := config.GetString("auth:token-signing-method")
+	if err != nil || !allowedSigningMethods[name] {
+		name = defaultSigningAlg
+	}
+	return jwt.GetSigningMethod(name)
+}
+
+// signingKey returns the key used to sign new tokens for the given method.
+// There is no insecure default: a deployment that forgets to set
+// "auth:token-key" (or the RSA key entries) fails to sign tokens rather
+// than silently using a secret that is public in this source file.
+func signingKey(method jwt.SigningMethod) (interface{}, error) {
+	if _, ok := method.(*jwt.SigningMethodRSA); ok {
+		keyPEM, err := config.GetString("auth:token-rsa-private-key")
+		if err != nil {
+			return nil, errors.New("auth:token-rsa-private-key is not set")
+		}
+		return jwt.ParseRSAPrivateKeyFromPEM([]byte(keyPEM))
+	}
+	secret, err := config.GetString("auth:token-key")
+	if err != nil {
+		return nil, errors.New("auth:token-key is not set")
+	}
+	return []byte(secret), nil
+}
+
+// verificationKey returns the key used to verify tokens signed with
+// method. Like signingKey, it fails closed when the relevant key is not
+// configured.
+func verificationKey(method jwt.SigningMethod) (interface{}, error) {
+	if _, ok := method.(*jwt.SigningMethodRSA); ok {
+		keyPEM, err := config.GetString("auth:token-rsa-public-key")
+		if err != nil {
+			return nil, errors.New("auth:token-rsa-public-key is not set")
+		}
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(keyPEM))
+	}
+	secret, err := config.GetString("auth:token-key")
+	if err != nil {
+		return nil, errors.New("auth:token-key is not set")
+	}
+	return []byte(secret), nil
+}
+
+func keyFunc(t *jwt.Token) (interface{}, error) {
+	alg, _ := t.Header["alg"].(string)
+	if !allowedSigningMethods[alg] {
+		return nil, fmt.Errorf("unexpected signing method: %v", alg)
+	}
+	return verificationKey(t.Method)
+}
+
+// signToken signs t in place: it embeds every field GetToken needs to
+// reconstruct t (UserEmail, AppName, Label, Scopes, Capabilities) as JWT
+// claims alongside the standard iss/sub/iat/exp, then sets t.Token and
+// t.ValidUntil to the result. Because all of a Token's authorization data
+// travels inside the signature, GetToken can verify and rebuild it without
+// reading the tokens collection; its only database lookup is the
+// revocation check. sub is recorded as the
+// standard "sub" claim (UserEmail or AppName, depending on the caller).
+func signToken(t *Token, sub string, ttl time.Duration) error {
+	method := signingMethod()
+	key, err := signingKey(method)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	validUntil := now.Add(ttl)
+	jt := jwt.New(method)
+	jt.Claims["iss"] = tokenIssuer
+	jt.Claims["sub"] = sub
+	jt.Claims["iat"] = now.Unix()
+	jt.Claims["exp"] = validUntil.Unix()
+	jt.Claims["email"] = t.UserEmail
+	jt.Claims["app"] = t.AppName
+	jt.Claims["label"] = t.Label
+	jt.Claims["scopes"] = t.Scopes
+	jt.Claims["capabilities"] = t.Capabilities
+	signed, err := jt.SignedString(key)
+	if err != nil {
+		return err
+	}
+	t.Token = signed
+	t.ValidUntil = validUntil
+	return nil
+}
+
+// stringsFromClaim converts a decoded JWT claim (a []interface{} of
+// strings, as produced by encoding/json for a JSON array) back into a
+// []string. Absent or malformed claims yield nil.
+func stringsFromClaim(raw interface{}) []string {
+	items, ok := raw.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// tokenFromClaims rebuilds a *Token entirely from tokenString's own
+// (already verified) claims, without consulting MongoDB.
+func tokenFromClaims(tokenString string, parsed *jwt.Token) (*Token, error) {
+	exp, ok := parsed.Claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token is missing the exp claim")
+	}
+	t := &Token{
+		Token:      tokenString,
+		ValidUntil: time.Unix(int64(exp), 0),
+	}
+	if email, ok := parsed.Claims["email"].(string); ok {
+		t.UserEmail = email
+	}
+	if app, ok := parsed.Claims["app"].(string); ok {
+		t.AppName = app
+	}
+	if label, ok := parsed.Claims["label"].(string); ok {
+		t.Label = label
+	}
+	t.Scopes = stringsFromClaim(parsed.Claims["scopes"])
+	t.Capabilities = stringsFromClaim(parsed.Claims["capabilities"])
+	return t, nil
+}
+
+// token generates an opaque, non-signed identifier. It backs the
+// single-use password reset tokens, which have no need for JWT claims.
+func token(data string, h crypto.Hash) string {
+	var random [64]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		data += time.Now().Format(time.RFC3339Nano)
+	} else {
+		data += string(random[:])
+	}
+	hash := h.New()
+	io.WriteString(hash, data)
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// newUserToken signs a new access token for u, with UserEmail as the
+// token's "sub" claim.
+func newUserToken(u *User) (*Token, error) {
+	if u == nil {
+		return nil, errors.New("User is nil")
+	}
+	if u.Email == "" {
+		return nil, errors.New("Impossible to generate tokens for users without email")
+	}
+	t := &Token{UserEmail: u.Email}
+	if err := signToken(t, u.Email, defaultTokenExpire); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// CreateNamedUserToken issues a new, labeled personal access token for
+// user, scoped to scopes. Unlike the single session token from
+// newUserToken, a user may hold several named tokens at once, each
+// independently revocable by its label.
+func CreateNamedUserToken(user *User, label string, scopes []string, ttl time.Duration) (*Token, error) {
+	if user == nil {
+		return nil, errors.New("User is nil")
+	}
+	if user.Email == "" {
+		return nil, errors.New("Impossible to generate tokens for users without email")
+	}
+	if label == "" {
+		return nil, errors.New("Label is required for named tokens")
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.Tokens().EnsureIndex(mgo.Index{
+		Key:    []string{"useremail", "label"},
+		Unique: true,
+		Sparse: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &Token{UserEmail: user.Email, Label: label, Scopes: scopes}
+	if err = signToken(t, user.Email, ttl); err != nil {
+		return nil, err
+	}
+	if err = conn.Tokens().Insert(t); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrDuplicateTokenLabel
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListUserTokens returns every token (session and named) currently
+// persisted for user.
+func ListUserTokens(user *User) ([]Token, error) {
+	if user == nil {
+		return nil, errors.New("User is nil")
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var tokens []Token
+	err = conn.Tokens().Find(bson.M{"useremail": user.Email}).All(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeUserTokenByLabel revokes the named token identified by label that
+// belongs to user.
+func RevokeUserTokenByLabel(user *User, label string) error {
+	if user == nil {
+		return errors.New("User is nil")
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var t Token
+	err = conn.Tokens().Find(bson.M{"useremail": user.Email, "label": label}).One(&t)
+	if err != nil {
+		return ErrTokenNotFound
+	}
+	return RevokeToken(t.Token, "revoked by label: "+label)
+}
+
+// CreateApplicationToken signs and persists a new access token for the
+// internal application/component identified by appName (e.g.
+// "tsuru-healer"), authorized only for the given capabilities (e.g.
+// "node:healer"). A compromised token then only grants whatever its
+// component actually needs, instead of full API access.
+func CreateApplicationToken(appName string, capabilities []string) (*Token, error) {
+	t := &Token{AppName: appName, Capabilities: capabilities}
+	if err := signToken(t, appName, defaultTokenExpire); err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.Tokens().Insert(t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// MigrateLegacyApplicationTokens grants legacyCapability to every
+// application token already in the database that has no capabilities of
+// its own, so existing deployments keep working across the upgrade to
+// capability-scoped tokens.
+func MigrateLegacyApplicationTokens() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Tokens().UpdateAll(
+		bson.M{
+			"appname": bson.M{"$ne": ""},
+			"$or": []bson.M{
+				{"capabilities": bson.M{"$exists": false}},
+				{"capabilities": bson.M{"$size": 0}},
+			},
+		},
+		bson.M{"$set": bson.M{"capabilities": []string{legacyCapability}}},
+	)
+	return err
+}
+
+// GetToken verifies tokenString's signature, "alg" header and expiry
+// locally, then reconstructs the Token entirely from its own claims, without
+// reading the tokens collection. The one database hit, made on every call
+// that gets this far, is the revocation check: "has this been revoked" can't be derived
+// from the token itself, since revocation means invalidating it before
+// its embedded exp says to.
+func GetToken(tokenString string) (*Token, error) {
+	if tokenString == "" {
+		return nil, ErrTokenNotFound
+	}
+	parsed, err := jwt.Parse(tokenString, keyFunc)
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, ErrTokenExpired
+		}
+		return nil, ErrTokenNotFound
+	}
+	if !parsed.Valid {
+		return nil, ErrTokenNotFound
+	}
+	t, err := tokenFromClaims(tokenString, parsed)
+	if err != nil {
+		return nil, ErrTokenNotFound
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var revoked revokedToken
+	if err = conn.RevokedTokens().FindId(tokenString).One(&revoked); err == nil {
+		return nil, ErrTokenRevoked
+	}
+	return t, nil
+}
+
+// revokedToken records that a token was invalidated before its natural
+// expiry. It is kept around only until ValidUntil (the revoked token's own
+// expiry), after which a TTL index removes it automatically: once the
+// token itself would no longer validate, there is no point auditing its
+// revocation anymore.
+type revokedToken struct {
+	Token      string    `bson:"_id"`
+	Reason     string    `bson:"reason"`
+	RevokedAt  time.Time `bson:"revokedat"`
+	ValidUntil time.Time `bson:"validuntil"`
+}
+
+// RevokeToken invalidates token immediately, recording reason for audit
+// purposes, long enough for GetToken to tell apart "never existed"/
+// "expired" from "was explicitly revoked" on its next call. Unlike
+// DeleteToken, it leaves token's document in Tokens() untouched.
+func RevokeToken(token, reason string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.RevokedTokens().EnsureIndex(mgo.Index{
+		Key:         []string{"validuntil"},
+		ExpireAfter: 1 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	validUntil := time.Now().Add(defaultTokenExpire)
+	var t Token
+	if err = conn.Tokens().Find(bson.M{"token": token}).One(&t); err == nil {
+		validUntil = t.ValidUntil
+	}
+	_, err = conn.RevokedTokens().UpsertId(token, revokedToken{
+		Token:      token,
+		Reason:     reason,
+		RevokedAt:  time.Now(),
+		ValidUntil: validUntil,
+	})
+	return err
+}
+
+// DeleteToken revokes token and removes its document from Tokens(). A
+// plain Tokens().Remove would not be enough to invalidate it: GetToken
+// rebuilds a Token straight from the JWT's own claims, so a removed-but-
+// unrevoked token would stay valid until its embedded exp.
+func DeleteToken(token string) error {
+	if err := RevokeToken(token, "deleted"); err != nil {
+		return err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Tokens().Remove(bson.M{"token": token})
+}
+
+// User returns the user that owns the token.
+func (t *Token) User() (*User, error) {
+	return GetUserByEmail(t.UserEmail)
+}
+
+// passwordTokenLimit backs the atomic counter that enforces
+// maxOutstandingPasswordTokens: Count is incremented by a single
+// findAndModify per request, so concurrent requests from the same user
+// can't all observe room under the limit and all insert, the way a
+// separate Find().Count() followed by Insert() could. ExpireAt carries a
+// TTL index, so the counter resets passwordTokenRateLimitWindow after it
+// is first created.
+type passwordTokenLimit struct {
+	UserEmail string    `bson:"_id"`
+	Count     int       `bson:"count"`
+	ExpireAt  time.Time `bson:"expireat"`
+}
+
+// createPasswordToken issues a single-use token for resetting u's
+// password. To blunt enumeration/spam, it refuses to create a new token
+// once maxOutstandingPasswordTokens have been requested for u within
+// passwordTokenRateLimitWindow of the first request. Every request counts,
+// including those whose tokens were already redeemed and those that were
+// refused, and the window is fixed, not rolling.
+func createPasswordToken(u *User) (*PasswordToken, error) {
+	if u == nil {
+		return nil, errors.New("User is nil")
+	}
+	if u.Email == "" {
+		return nil, errors.New("User email is empty")
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.PasswordTokenLimits().EnsureIndex(mgo.Index{
+		Key:         []string{"expireat"},
+		ExpireAfter: 1 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	change := mgo.Change{
+		Update: bson.M{
+			"$inc":         bson.M{"count": 1},
+			"$setOnInsert": bson.M{"expireat": time.Now().Add(passwordTokenRateLimitWindow)},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var limit passwordTokenLimit
+	_, err = conn.PasswordTokenLimits().FindId(u.Email).Apply(change, &limit)
+	if err != nil {
+		return nil, err
+	}
+	if limit.Count > maxOutstandingPasswordTokens {
+		return nil, ErrTooManyPasswordTokens
+	}
+	now := time.Now()
+	t := PasswordToken{
+		Token:      token(u.Email, crypto.SHA1),
+		UserEmail:  u.Email,
+		ValidUntil: now.Add(passwordTokenExpiration()),
+		CreatedAt:  now,
+	}
+	err = conn.PasswordTokens().Insert(t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetPasswordToken looks up a password reset token, refusing it if it has
+// already been used or has expired.
+func GetPasswordToken(token string) (*PasswordToken, error) {
+	if token == "" {
+		return nil, ErrTokenNotFound
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var t PasswordToken
+	err = conn.PasswordTokens().FindId(token).One(&t)
+	if err != nil {
+		return nil, ErrTokenNotFound
+	}
+	if t.Used {
+		return nil, ErrPasswordTokenUsed
+	}
+	if t.ValidUntil.Before(time.Now()) {
+		return nil, ErrPasswordTokenExpired
+	}
+	return &t, nil
+}
+
+// UsePasswordToken redeems token, setting newPassword on its owner. The
+// redemption itself is a MongoDB findAndModify against {used: false}, so
+// if two requests race to redeem the same token, only one of them observes
+// the document with used still false and thus only one succeeds.
+func UsePasswordToken(token, newPassword string) (*User, error) {
+	if newPassword == "" {
+		return nil, errors.New("New password is empty")
+	}
+	pt, err := GetPasswordToken(token)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"used": true}}}
+	var prev PasswordToken
+	_, err = conn.PasswordTokens().Find(bson.M{"_id": token, "used": false}).Apply(change, &prev)
+	if err != nil {
+		return nil, ErrPasswordTokenUsed
+	}
+	u, err := GetUserByEmail(pt.UserEmail)
+	if err != nil {
+		return nil, err
+	}
+	u.Password = newPassword
+	err = conn.Users().Update(bson.M{"email": u.Email}, u)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
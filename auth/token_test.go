@@ -7,7 +7,6 @@ package auth
 import (
 	"crypto"
 	"encoding/json"
-	"fmt"
 	"labix.org/v2/mgo/bson"
 	"launchpad.net/gocheck"
 	"sync"
@@ -68,19 +67,42 @@ func (s *S) TestGetTokenNotFound(c *gocheck.C) {
 }
 
 func (s *S) TestGetExpiredToken(c *gocheck.C) {
-	t, err := CreateApplicationToken("tsuru-healer")
+	t := &Token{AppName: "tsuru-healer", Capabilities: []string{"node:healer"}}
+	err := signToken(t, "tsuru-healer", -time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	t2, err := GetToken(t.Token)
+	c.Assert(t2, gocheck.IsNil)
+	c.Assert(err, gocheck.Equals, ErrTokenExpired)
+}
+
+func (s *S) TestGetRevokedToken(c *gocheck.C) {
+	t, err := CreateApplicationToken("tsuru-healer", []string{"node:healer"})
 	c.Assert(err, gocheck.IsNil)
 	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
-	t.ValidUntil = time.Now().Add(-24 * time.Hour)
-	s.conn.Tokens().Update(bson.M{"token": t.Token}, t)
+	defer s.conn.RevokedTokens().RemoveId(t.Token)
+	err = RevokeToken(t.Token, "compromised")
+	c.Assert(err, gocheck.IsNil)
 	t2, err := GetToken(t.Token)
 	c.Assert(t2, gocheck.IsNil)
-	c.Assert(err, gocheck.NotNil)
-	c.Assert(err.Error(), gocheck.Equals, "Token has expired")
+	c.Assert(err, gocheck.Equals, ErrTokenRevoked)
+}
+
+func (s *S) TestRevokeTokenRecordsReasonAndExpiry(c *gocheck.C) {
+	t, err := CreateApplicationToken("tsuru-healer", []string{"node:healer"})
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	defer s.conn.RevokedTokens().RemoveId(t.Token)
+	err = RevokeToken(t.Token, "compromised")
+	c.Assert(err, gocheck.IsNil)
+	var revoked revokedToken
+	err = s.conn.RevokedTokens().FindId(t.Token).One(&revoked)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(revoked.Reason, gocheck.Equals, "compromised")
+	c.Assert(revoked.ValidUntil.Equal(t.ValidUntil.Truncate(time.Millisecond)), gocheck.Equals, true)
 }
 
 func (s *S) TestCreateApplicationToken(c *gocheck.C) {
-	t, err := CreateApplicationToken("tsuru-healer")
+	t, err := CreateApplicationToken("tsuru-healer", []string{"node:healer"})
 	c.Assert(err, gocheck.IsNil)
 	c.Assert(t, gocheck.NotNil)
 	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
@@ -88,21 +110,98 @@ func (s *S) TestCreateApplicationToken(c *gocheck.C) {
 	c.Assert(err, gocheck.IsNil)
 	c.Assert(n, gocheck.Equals, 1)
 	c.Assert(t.AppName, gocheck.Equals, "tsuru-healer")
+	c.Assert(t.Capabilities, gocheck.DeepEquals, []string{"node:healer"})
+}
+
+func (s *S) TestCreateApplicationTokenCapabilitiesAreEnforced(c *gocheck.C) {
+	t, err := CreateApplicationToken("tsuru-healer", []string{"node:healer"})
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	c.Assert(t.Authorize("node:healer"), gocheck.Equals, true)
+	c.Assert(t.Authorize("app:deploy"), gocheck.Equals, false)
+	c.Assert(t.Authorize("metrics:read"), gocheck.Equals, false)
+}
+
+func (s *S) TestMigrateLegacyApplicationTokens(c *gocheck.C) {
+	t, err := CreateApplicationToken("tsuru-old-deployer", nil)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	c.Assert(t.Authorize("app:deploy"), gocheck.Equals, false)
+	err = MigrateLegacyApplicationTokens()
+	c.Assert(err, gocheck.IsNil)
+	var migrated Token
+	err = s.conn.Tokens().Find(bson.M{"token": t.Token}).One(&migrated)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(migrated.Capabilities, gocheck.DeepEquals, []string{legacyCapability})
+	c.Assert(migrated.Authorize("app:deploy"), gocheck.Equals, true)
+	c.Assert(migrated.Authorize("node:healer"), gocheck.Equals, true)
 }
 
 func (s *S) TestTokenMarshalJSON(c *gocheck.C) {
-	valid := time.Now()
-	t := Token{
-		Token:      "12saii",
-		ValidUntil: valid,
-		UserEmail:  "something@something.com",
-		AppName:    "myapp",
+	t := &Token{
+		UserEmail: "something@something.com",
+		AppName:   "myapp",
+		Label:     "my-laptop",
+		Scopes:    []string{"app-deploy", "app-read"},
+	}
+	err := signToken(t, "something@something.com", time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	b, err := json.Marshal(t)
+	c.Assert(err, gocheck.IsNil)
+	var got map[string]interface{}
+	err = json.Unmarshal(b, &got)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(got["token"], gocheck.Matches, `^[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+$`)
+	c.Assert(got["email"], gocheck.Equals, "something@something.com")
+	c.Assert(got["app"], gocheck.Equals, "myapp")
+	c.Assert(got["label"], gocheck.Equals, "my-laptop")
+	c.Assert(got["scopes"], gocheck.DeepEquals, []interface{}{"app-deploy", "app-read"})
+	c.Assert(got["valid-until"], gocheck.Equals, t.ValidUntil.Format(time.RFC3339Nano))
+}
+
+func (s *S) TestCreateNamedUserToken(c *gocheck.C) {
+	t, err := CreateNamedUserToken(s.user, "my-laptop", []string{"app-deploy"}, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	c.Assert(t.Label, gocheck.Equals, "my-laptop")
+	c.Assert(t.Scopes, gocheck.DeepEquals, []string{"app-deploy"})
+	c.Assert(t.HasScope("app-deploy"), gocheck.Equals, true)
+	c.Assert(t.HasScope("app-read"), gocheck.Equals, false)
+}
+
+func (s *S) TestCreateNamedUserTokenDuplicateLabel(c *gocheck.C) {
+	t, err := CreateNamedUserToken(s.user, "my-laptop", []string{"app-deploy"}, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	_, err = CreateNamedUserToken(s.user, "my-laptop", []string{"app-read"}, time.Hour)
+	c.Assert(err, gocheck.Equals, ErrDuplicateTokenLabel)
+}
+
+func (s *S) TestListUserTokens(c *gocheck.C) {
+	t, err := CreateNamedUserToken(s.user, "my-laptop", []string{"app-deploy"}, time.Hour)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	tokens, err := ListUserTokens(s.user)
+	c.Assert(err, gocheck.IsNil)
+	found := false
+	for _, tok := range tokens {
+		if tok.Label == "my-laptop" {
+			found = true
+		}
 	}
-	b, err := json.Marshal(&t)
+	c.Assert(found, gocheck.Equals, true)
+}
+
+func (s *S) TestRevokeUserTokenByLabel(c *gocheck.C) {
+	t, err := CreateNamedUserToken(s.user, "my-laptop", []string{"app-deploy"}, time.Hour)
 	c.Assert(err, gocheck.IsNil)
-	want := fmt.Sprintf(`{"token":"12saii","valid-until":"%s","email":"something@something.com","app":"myapp"}`,
-		valid.Format(time.RFC3339Nano))
-	c.Assert(string(b), gocheck.Equals, want)
+	defer s.conn.Tokens().Remove(bson.M{"token": t.Token})
+	defer s.conn.RevokedTokens().RemoveId(t.Token)
+	err = RevokeUserTokenByLabel(s.user, "my-laptop")
+	c.Assert(err, gocheck.IsNil)
+	t2, err := GetToken(t.Token)
+	c.Assert(t2, gocheck.IsNil)
+	c.Assert(err, gocheck.Equals, ErrTokenRevoked)
 }
 
 func (s *S) TestTokenGetUser(c *gocheck.C) {
@@ -119,13 +218,16 @@ func (s *S) TestTokenGetUserUnknownEmail(c *gocheck.C) {
 }
 
 func (s *S) TestDeleteToken(c *gocheck.C) {
-	t, err := CreateApplicationToken("tsuru-healer")
+	t, err := CreateApplicationToken("tsuru-healer", []string{"node:healer"})
 	c.Assert(err, gocheck.IsNil)
+	defer s.conn.RevokedTokens().RemoveId(t.Token)
 	err = DeleteToken(t.Token)
 	c.Assert(err, gocheck.IsNil)
+	n, err := s.conn.Tokens().Find(bson.M{"token": t.Token}).Count()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(n, gocheck.Equals, 0)
 	_, err = GetToken(t.Token)
-	c.Assert(err, gocheck.NotNil)
-	c.Assert(err.Error(), gocheck.Equals, "Token not found")
+	c.Assert(err, gocheck.Equals, ErrTokenRevoked)
 }
 
 func (s *S) TestCreatePasswordToken(c *gocheck.C) {
@@ -157,3 +259,46 @@ func (s *S) TestCreatePasswordTokenErrors(c *gocheck.C) {
 		c.Check(err.Error(), gocheck.Equals, t.want)
 	}
 }
+
+func (s *S) TestGetPasswordTokenExpired(c *gocheck.C) {
+	u := User{Email: "pure@alanis.com"}
+	t, err := createPasswordToken(&u)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.PasswordTokens().RemoveId(t.Token)
+	t.ValidUntil = time.Now().Add(-time.Hour)
+	err = s.conn.PasswordTokens().UpdateId(t.Token, t)
+	c.Assert(err, gocheck.IsNil)
+	got, err := GetPasswordToken(t.Token)
+	c.Assert(got, gocheck.IsNil)
+	c.Assert(err, gocheck.Equals, ErrPasswordTokenExpired)
+}
+
+func (s *S) TestUsePasswordTokenIsSingleUse(c *gocheck.C) {
+	u := User{Email: "pure@alanis.com"}
+	err := s.conn.Users().Insert(&u)
+	c.Assert(err, gocheck.IsNil)
+	t, err := createPasswordToken(&u)
+	c.Assert(err, gocheck.IsNil)
+	defer s.conn.PasswordTokens().RemoveId(t.Token)
+	_, err = UsePasswordToken(t.Token, "newpassword")
+	c.Assert(err, gocheck.IsNil)
+	got, err := GetPasswordToken(t.Token)
+	c.Assert(got, gocheck.IsNil)
+	c.Assert(err, gocheck.Equals, ErrPasswordTokenUsed)
+	_, err = UsePasswordToken(t.Token, "otherpassword")
+	c.Assert(err, gocheck.Equals, ErrPasswordTokenUsed)
+}
+
+func (s *S) TestCreatePasswordTokenRateLimit(c *gocheck.C) {
+	u := User{Email: "pure@alanis.com"}
+	var last *PasswordToken
+	for i := 0; i < maxOutstandingPasswordTokens; i++ {
+		t, err := createPasswordToken(&u)
+		c.Assert(err, gocheck.IsNil)
+		defer s.conn.PasswordTokens().RemoveId(t.Token)
+		last = t
+	}
+	c.Assert(last, gocheck.NotNil)
+	_, err := createPasswordToken(&u)
+	c.Assert(err, gocheck.Equals, ErrTooManyPasswordTokens)
+}
@@ -0,0 +1,40 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"errors"
+
+	"github.com/tsuru/tsuru/db"
+	"labix.org/v2/mgo/bson"
+)
+
+// User represents a tsuru user, identified by its email address.
+type User struct {
+	Email    string
+	Password string
+}
+
+// GetUserByEmail looks up a user by email address in the database.
+func GetUserByEmail(email string) (*User, error) {
+	if !validateEmail(email) {
+		return nil, errors.New("User not found")
+	}
+	var u User
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.Users().Find(bson.M{"email": email}).One(&u)
+	if err != nil {
+		return nil, errors.New("User not found")
+	}
+	return &u, nil
+}
+
+func validateEmail(email string) bool {
+	return email != ""
+}
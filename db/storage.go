@@ -0,0 +1,89 @@
+// Copyright 2013 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package db provides a generic implementation for the database layer,
+// including connection management and access to the collections used by
+// the rest of tsuru.
+package db
+
+import (
+	"github.com/tsuru/config"
+	"labix.org/v2/mgo"
+)
+
+const (
+	DefaultDatabaseURL  = "127.0.0.1:27017"
+	DefaultDatabaseName = "tsuru"
+)
+
+// Storage holds the connection with the database.
+type Storage struct {
+	session *mgo.Session
+	dbname  string
+}
+
+func open(addr, dbname string) (*Storage, error) {
+	session, err := mgo.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{session: session, dbname: dbname}, nil
+}
+
+// Conn reads the database url and database name from the configuration file
+// (keys "database:url" and "database:name") and opens a new connection,
+// falling back to DefaultDatabaseURL/DefaultDatabaseName when they are not
+// set.
+func Conn() (*Storage, error) {
+	url, err := config.GetString("database:url")
+	if err != nil {
+		url = DefaultDatabaseURL
+	}
+	dbname, err := config.GetString("database:name")
+	if err != nil {
+		dbname = DefaultDatabaseName
+	}
+	return open(url, dbname)
+}
+
+// Close closes the underlying session, releasing the connection back to the
+// pool.
+func (s *Storage) Close() {
+	s.session.Close()
+}
+
+// Collection returns a reference to the named collection.
+func (s *Storage) Collection(name string) *mgo.Collection {
+	return s.session.DB(s.dbname).C(name)
+}
+
+// Users returns the users collection.
+func (s *Storage) Users() *mgo.Collection {
+	return s.Collection("users")
+}
+
+// Tokens returns the tokens collection, used to store authentication
+// tokens issued to users and applications.
+func (s *Storage) Tokens() *mgo.Collection {
+	return s.Collection("tokens")
+}
+
+// PasswordTokens returns the password_tokens collection, used to store
+// tokens issued for password reset requests.
+func (s *Storage) PasswordTokens() *mgo.Collection {
+	return s.Collection("password_tokens")
+}
+
+// RevokedTokens returns the revoked_tokens collection, used to keep an
+// audit trail of tokens invalidated before their natural expiry.
+func (s *Storage) RevokedTokens() *mgo.Collection {
+	return s.Collection("revoked_tokens")
+}
+
+// PasswordTokenLimits returns the password_token_limits collection, used to
+// atomically enforce the per-user rate limit on outstanding password reset
+// tokens.
+func (s *Storage) PasswordTokenLimits() *mgo.Collection {
+	return s.Collection("password_token_limits")
+}